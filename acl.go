@@ -0,0 +1,90 @@
+// Copyright (c) 2019 Sunil Nimmagadda <sunil@nimmagadda.net>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import "regexp"
+
+// aclVerdict is the outcome of matching a message against the ACL rules.
+type aclVerdict int
+
+const (
+	aclNone aclVerdict = iota
+	aclAllow
+	aclDeny
+	aclSkip
+)
+
+// aclRule is a single ordered allow/deny/skip directive matched against
+// either the envelope sender ("from") or recipient ("rcpt").
+type aclRule struct {
+	verdict aclVerdict
+	field   string // "from" or "rcpt"
+	re      *regexp.Regexp
+	code    string // SMTP code/reason used when verdict is aclDeny
+}
+
+// acl is the compiled, ordered set of rules loaded from the config
+// file. Rules are evaluated in order and the first match wins.
+type acl struct {
+	rules []*aclRule
+}
+
+func newACL(cfgRules []aclRuleConfig) (*acl, error) {
+	a := &acl{}
+	for _, rc := range cfgRules {
+		re, err := regexp.Compile("(?i)" + rc.pattern)
+		if err != nil {
+			return nil, err
+		}
+		verdict := aclNone
+		switch rc.action {
+		case "allow":
+			verdict = aclAllow
+		case "deny":
+			verdict = aclDeny
+		case "skip":
+			verdict = aclSkip
+		}
+		code := rc.code
+		if code == "" {
+			code = "550 message rejected"
+		}
+		a.rules = append(a.rules, &aclRule{
+			verdict: verdict,
+			field:   rc.field,
+			re:      re,
+			code:    code,
+		})
+	}
+	return a, nil
+}
+
+// match returns the verdict (and, for aclDeny, the SMTP reason) of the
+// first rule whose field matches value. aclNone is returned when no
+// rule matches.
+func (a *acl) match(field, value string) (aclVerdict, string) {
+	if a == nil {
+		return aclNone, ""
+	}
+	for _, r := range a.rules {
+		if r.field != field {
+			continue
+		}
+		if r.re.MatchString(value) {
+			return r.verdict, r.code
+		}
+	}
+	return aclNone, ""
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2019 Sunil Nimmagadda <sunil@nimmagadda.net>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"io"
+	"log"
+	"testing"
+)
+
+func TestACLMatchOrdering(t *testing.T) {
+	a, err := newACL([]aclRuleConfig{
+		{action: "deny", field: "from", pattern: `.*@mailinator\.com`},
+		{action: "allow", field: "rcpt", pattern: `postmaster@.*`},
+		{action: "skip", field: "from", pattern: `trusted-relay@partner\.com`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		field, value string
+		want         aclVerdict
+	}{
+		{"from", "spammer@mailinator.com", aclDeny},
+		{"rcpt", "postmaster@example.com", aclAllow},
+		{"from", "trusted-relay@partner.com", aclSkip},
+		{"from", "nobody@example.com", aclNone},
+	}
+	for _, tc := range tests {
+		if got, _ := a.match(tc.field, tc.value); got != tc.want {
+			t.Errorf("match(%q, %q) = %v, want %v", tc.field, tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestACLFirstMatchWins(t *testing.T) {
+	a, err := newACL([]aclRuleConfig{
+		{action: "deny", field: "rcpt", pattern: `.*@blocked\.example`},
+		{action: "allow", field: "rcpt", pattern: `.*@blocked\.example`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := a.match("rcpt", "user@blocked.example"); got != aclDeny {
+		t.Errorf("expected the first matching rule (deny) to win, got %v", got)
+	}
+}
+
+func TestSessionRecordACLDenyIsSticky(t *testing.T) {
+	s := &session{}
+	s.recordACL(aclDeny, "550 message rejected")
+	s.recordACL(aclAllow, "")
+	s.recordACL(aclSkip, "")
+	if s.aclVerdict != aclDeny {
+		t.Fatalf("deny verdict was downgraded to %v", s.aclVerdict)
+	}
+	if s.aclReason != "550 message rejected" {
+		t.Fatalf("deny reason was overwritten: %q", s.aclReason)
+	}
+}
+
+func TestSessionRecordACLLatestNonDenyWins(t *testing.T) {
+	s := &session{}
+	s.recordACL(aclAllow, "allow1")
+	s.recordACL(aclSkip, "skip1")
+	if s.aclVerdict != aclSkip || s.aclReason != "skip1" {
+		t.Fatalf("got verdict=%v reason=%q, want skip/skip1", s.aclVerdict, s.aclReason)
+	}
+}
+
+// TestTxRcptDenyDoesNotEscalate ensures a rcpt-scoped deny only rejects
+// that one recipient and leaves the transaction-wide verdict alone, so
+// an unrelated recipient in the same transaction isn't bounced at DATA.
+func TestTxRcptDenyDoesNotEscalate(t *testing.T) {
+	stdout = log.New(io.Discard, "", 0)
+	origRules := rules
+	defer func() { rules = origRules }()
+	var err error
+	rules, err = newACL([]aclRuleConfig{
+		{action: "deny", field: "rcpt", pattern: `.*@blocked\.example`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &session{id: "1", control: map[string]string{}}
+	txRcpt(s, []string{"", "", "", "", "", "", "tok1", "a@ok.example", "ok"})
+	if s.aclVerdict != aclNone {
+		t.Fatalf("unrelated recipient left session verdict at %v, want aclNone", s.aclVerdict)
+	}
+
+	txRcpt(s, []string{"", "", "", "", "", "", "tok2", "b@blocked.example", "ok"})
+	if s.aclVerdict == aclDeny {
+		t.Fatalf("rcpt-scoped deny escalated into the transaction-wide verdict")
+	}
+}
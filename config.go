@@ -0,0 +1,388 @@
+// Copyright (c) 2019 Sunil Nimmagadda <sunil@nimmagadda.net>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultConfigPath = "/etc/mail/filter-rspamd.conf"
+
+// endpointConfig describes a single rspamd endpoint: how to reach it,
+// how to authenticate to it and how long to wait for it.
+type endpointConfig struct {
+	scheme             string
+	host               string
+	port               string
+	path               string
+	username           string
+	password           string
+	controllerPassword string
+	caFile             string
+	clientCertFile     string
+	clientKeyFile      string
+	insecureSkipVerify bool
+	timeout            time.Duration
+}
+
+// aclRuleConfig is one line of an "acl { ... }" block: an ordered
+// allow/deny/skip directive matched against an envelope field.
+type aclRuleConfig struct {
+	action  string // "allow", "deny" or "skip"
+	field   string // "from" or "rcpt"
+	pattern string
+	code    string
+}
+
+// dkimSignerConfig describes a local DKIM signing key used as a
+// fallback when rspamd does not emit its own dkim-signature.
+type dkimSignerConfig struct {
+	domain   string
+	selector string
+	keyFile  string
+	headers  []string
+}
+
+// throttleConfig configures the per-connection/per-IP limits and the
+// optional Prometheus metrics listener. A zero value for any limit
+// means that limit is disabled.
+type throttleConfig struct {
+	maxConcurrent      int
+	maxConcurrentPerIP int
+	rateLimit          int
+	rateWindow         time.Duration
+	metricsListen      string
+}
+
+const (
+	defaultRequestTimeout = 30 * time.Second
+	defaultTxBudget       = 5 * time.Minute
+)
+
+// config holds the settings read from the filter's configuration file.
+// When no file is present a single endpoint pointing at the historical
+// default (http://localhost:11333/checkv2) is used so existing
+// deployments keep working unmodified.
+type config struct {
+	endpoints      []*endpointConfig
+	aclRules       []aclRuleConfig
+	dkimSigners    []dkimSignerConfig
+	throttle       throttleConfig
+	requestTimeout time.Duration // per-rspamd-request deadline
+	txBudget       time.Duration // deadline for one transaction's requests, renewed at tx-commit/tx-rollback; 0 disables it
+}
+
+func defaultConfig() *config {
+	return &config{
+		endpoints: []*endpointConfig{
+			{
+				scheme:  "http",
+				host:    "localhost",
+				port:    "11333",
+				path:    "/checkv2",
+				timeout: 10 * time.Second,
+			},
+		},
+		requestTimeout: defaultRequestTimeout,
+		txBudget:       defaultTxBudget,
+	}
+}
+
+// parseConfig reads a small directive-based configuration file:
+//
+//	endpoint {
+//		server 10.0.0.1
+//		port 11334
+//		tls.enabled yes
+//		tls.insecure-skip-verify no
+//		username relay
+//		password secret
+//		timeout 10
+//	}
+//
+//	acl {
+//		deny from ".*@mailinator\.com"
+//		allow rcpt "postmaster@.*"
+//		skip from "trusted-relay@partner\.com"
+//		deny rcpt ".*@blocked\.example" code "550 5.7.1 rejected"
+//	}
+//
+//	dkim {
+//		domain example.com
+//		selector mail
+//		key-file /etc/mail/dkim/example.com.key
+//		headers From,To,Subject,Date,Message-Id
+//	}
+//
+//	throttle {
+//		max-concurrent 100
+//		max-concurrent-per-ip 10
+//		rate-limit 20
+//		rate-window 60
+//		metrics-listen 127.0.0.1:9100
+//	}
+//
+//	request-timeout 30
+//	tx-budget 300
+//
+// Endpoints are tried in the order they appear in the file; acl rules
+// are evaluated in order with the first match winning. Lines starting
+// with '#' and blank lines are ignored.
+func parseConfig(path string) (*config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cfg := &config{requestTimeout: defaultRequestTimeout, txBudget: defaultTxBudget}
+	var cur *endpointConfig
+	var curDKIM *dkimSignerConfig
+	inACL := false
+	inThrottle := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "request-timeout ") {
+			secs, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "request-timeout")))
+			if err != nil {
+				return nil, fmt.Errorf("config: invalid request-timeout %q: %w", line, err)
+			}
+			cfg.requestTimeout = time.Duration(secs) * time.Second
+			continue
+		}
+		if strings.HasPrefix(line, "tx-budget ") {
+			secs, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "tx-budget")))
+			if err != nil {
+				return nil, fmt.Errorf("config: invalid tx-budget %q: %w", line, err)
+			}
+			cfg.txBudget = time.Duration(secs) * time.Second
+			continue
+		}
+		if line == "endpoint {" {
+			cur = &endpointConfig{
+				scheme:  "http",
+				port:    "11333",
+				path:    "/checkv2",
+				timeout: 10 * time.Second,
+			}
+			continue
+		}
+		if line == "throttle {" {
+			inThrottle = true
+			continue
+		}
+		if line == "acl {" {
+			inACL = true
+			continue
+		}
+		if line == "dkim {" {
+			curDKIM = &dkimSignerConfig{}
+			continue
+		}
+		if line == "}" {
+			if cur != nil {
+				if cur.host == "" {
+					return nil, fmt.Errorf("config: endpoint block missing required \"server\" directive")
+				}
+				cfg.endpoints = append(cfg.endpoints, cur)
+				cur = nil
+			}
+			if curDKIM != nil {
+				cfg.dkimSigners = append(cfg.dkimSigners, *curDKIM)
+				curDKIM = nil
+			}
+			inACL = false
+			inThrottle = false
+			continue
+		}
+		if inACL {
+			rule, err := parseACLRule(line)
+			if err != nil {
+				return nil, err
+			}
+			cfg.aclRules = append(cfg.aclRules, rule)
+			continue
+		}
+		if inThrottle {
+			fields := strings.SplitN(line, " ", 2)
+			if len(fields) != 2 {
+				continue
+			}
+			key, value := fields[0], strings.TrimSpace(fields[1])
+			var n int
+			switch key {
+			case "max-concurrent", "max-concurrent-per-ip", "rate-limit", "rate-window":
+				n, err = strconv.Atoi(value)
+				if err != nil {
+					return nil, fmt.Errorf("config: invalid %s %q: %w", key, value, err)
+				}
+			}
+			switch key {
+			case "max-concurrent":
+				cfg.throttle.maxConcurrent = n
+			case "max-concurrent-per-ip":
+				cfg.throttle.maxConcurrentPerIP = n
+			case "rate-limit":
+				cfg.throttle.rateLimit = n
+			case "rate-window":
+				cfg.throttle.rateWindow = time.Duration(n) * time.Second
+			case "metrics-listen":
+				cfg.throttle.metricsListen = value
+			}
+			continue
+		}
+		if curDKIM != nil {
+			fields := strings.SplitN(line, " ", 2)
+			if len(fields) != 2 {
+				continue
+			}
+			key, value := fields[0], strings.TrimSpace(fields[1])
+			switch key {
+			case "domain":
+				curDKIM.domain = value
+			case "selector":
+				curDKIM.selector = value
+			case "key-file":
+				curDKIM.keyFile = value
+			case "headers":
+				curDKIM.headers = strings.Split(value, ",")
+				for i := range curDKIM.headers {
+					curDKIM.headers[i] = strings.ToLower(strings.TrimSpace(curDKIM.headers[i]))
+				}
+			}
+			continue
+		}
+		if cur == nil {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		key, value := fields[0], strings.TrimSpace(fields[1])
+		switch key {
+		case "server":
+			cur.host = value
+		case "port":
+			cur.port = value
+		case "tls.enabled":
+			if value == "yes" {
+				cur.scheme = "https"
+			}
+		case "tls.insecure-skip-verify":
+			cur.insecureSkipVerify = value == "yes"
+		case "tls.ca-file":
+			cur.caFile = value
+		case "tls.client-cert":
+			cur.clientCertFile = value
+		case "tls.client-key":
+			cur.clientKeyFile = value
+		case "username":
+			cur.username = value
+		case "password":
+			cur.password = value
+		case "controller-password":
+			cur.controllerPassword = value
+		case "timeout":
+			secs, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("config: invalid timeout %q: %w", value, err)
+			}
+			cur.timeout = time.Duration(secs) * time.Second
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(cfg.endpoints) == 0 {
+		return nil, fmt.Errorf("config: no endpoint defined in %s", path)
+	}
+	return cfg, nil
+}
+
+// parseACLRule parses a single line of an acl block, e.g.:
+//
+//	deny from ".*@mailinator\.com" code "550 5.7.1 rejected"
+func parseACLRule(line string) (aclRuleConfig, error) {
+	tokens, err := tokenizeACLRule(line)
+	if err != nil {
+		return aclRuleConfig{}, err
+	}
+	if len(tokens) != 3 && len(tokens) != 5 {
+		return aclRuleConfig{}, fmt.Errorf("config: malformed acl rule %q", line)
+	}
+	rule := aclRuleConfig{action: tokens[0], field: tokens[1], pattern: tokens[2]}
+	if len(tokens) == 5 {
+		if tokens[3] != "code" {
+			return aclRuleConfig{}, fmt.Errorf("config: malformed acl rule %q", line)
+		}
+		rule.code = tokens[4]
+	}
+	return rule, nil
+}
+
+// tokenizeACLRule splits an acl rule line on spaces while treating
+// "double quoted strings" as a single token.
+func tokenizeACLRule(line string) ([]string, error) {
+	var tokens []string
+	var b strings.Builder
+	inQuotes := false
+	for _, r := range line {
+		switch {
+		case r == '"':
+			if inQuotes {
+				tokens = append(tokens, b.String())
+				b.Reset()
+			}
+			inQuotes = !inQuotes
+		case r == ' ' && !inQuotes:
+			if b.Len() > 0 {
+				tokens = append(tokens, b.String())
+				b.Reset()
+			}
+		default:
+			b.WriteRune(r)
+		}
+	}
+	if inQuotes {
+		return nil, fmt.Errorf("config: unterminated quote in acl rule %q", line)
+	}
+	if b.Len() > 0 {
+		tokens = append(tokens, b.String())
+	}
+	return tokens, nil
+}
+
+// loadConfig reads the configuration at path, falling back to the
+// historical localhost default when the file does not exist.
+func loadConfig(path string) (*config, error) {
+	cfg, err := parseConfig(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return defaultConfig(), nil
+		}
+		return nil, err
+	}
+	return cfg, nil
+}
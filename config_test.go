@@ -0,0 +1,77 @@
+// Copyright (c) 2019 Sunil Nimmagadda <sunil@nimmagadda.net>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "filter-rspamd.conf")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseConfigEndpointDefaults(t *testing.T) {
+	path := writeConfig(t, `
+endpoint {
+	server 10.0.0.1
+}
+`)
+	cfg, err := parseConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.endpoints) != 1 {
+		t.Fatalf("got %d endpoints, want 1", len(cfg.endpoints))
+	}
+	ep := cfg.endpoints[0]
+	if ep.host != "10.0.0.1" {
+		t.Errorf("host = %q, want 10.0.0.1", ep.host)
+	}
+	if ep.scheme != "http" || ep.port != "11333" || ep.path != "/checkv2" {
+		t.Errorf("got scheme=%q port=%q path=%q, want defaults", ep.scheme, ep.port, ep.path)
+	}
+	if ep.timeout != 10*time.Second {
+		t.Errorf("timeout = %v, want 10s", ep.timeout)
+	}
+}
+
+func TestParseConfigEndpointMissingServer(t *testing.T) {
+	path := writeConfig(t, `
+endpoint {
+	port 11334
+}
+`)
+	if _, err := parseConfig(path); err == nil {
+		t.Fatal("expected an error for an endpoint block missing \"server\", got nil")
+	}
+}
+
+func TestParseConfigUnknownFileFallsBackToDefault(t *testing.T) {
+	cfg, err := loadConfig(filepath.Join(t.TempDir(), "does-not-exist.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.endpoints) != 1 || cfg.endpoints[0].host != "localhost" {
+		t.Fatalf("got %+v, want the localhost default", cfg.endpoints)
+	}
+}
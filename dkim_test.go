@@ -0,0 +1,173 @@
+// Copyright (c) 2019 Sunil Nimmagadda <sunil@nimmagadda.net>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCanonicalizeHeaderRelaxed(t *testing.T) {
+	tests := []struct{ name, value, want string }{
+		{"Subject", "  hello   world  ", "subject:hello world"},
+		{"From", "a@example.com", "from:a@example.com"},
+		{"X-Mixed-Case", "v1  v2", "x-mixed-case:v1 v2"},
+	}
+	for _, tc := range tests {
+		if got := canonicalizeHeaderRelaxed(tc.name, tc.value); got != tc.want {
+			t.Errorf("canonicalizeHeaderRelaxed(%q, %q) = %q, want %q", tc.name, tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestCanonicalizeBodyRelaxed(t *testing.T) {
+	tests := []struct{ name, body, want string }{
+		{"trailing whitespace trimmed", "line1   \r\nline2\t\r\n", "line1\r\nline2\r\n"},
+		{"trailing blank lines dropped", "line1\r\n\r\n\r\n", "line1\r\n"},
+		{"empty body", "", ""},
+		{"whitespace-only body", "   \r\n\r\n", ""},
+	}
+	for _, tc := range tests {
+		if got := string(canonicalizeBodyRelaxed(tc.body)); got != tc.want {
+			t.Errorf("%s: canonicalizeBodyRelaxed(%q) = %q, want %q", tc.name, tc.body, got, tc.want)
+		}
+	}
+}
+
+// genTestKey writes a PKCS8-encoded RSA key to a temp file and returns
+// both the file path and the key, so the caller can verify signatures
+// independently of newDKIMSigners/sign.
+func genTestKey(t *testing.T) (string, *rsa.PrivateKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "dkim.key")
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(path, pemBytes, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path, key
+}
+
+func TestDKIMSignRoundTrip(t *testing.T) {
+	keyFile, key := genTestKey(t)
+	ds, err := newDKIMSigners([]dkimSignerConfig{
+		{domain: "example.com", selector: "mail", keyFile: keyFile, headers: []string{"from", "subject"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := ds.forDomain("sender@example.com")
+	if signer == nil {
+		t.Fatal("forDomain returned nil for a configured domain")
+	}
+
+	hdrs := headerList{
+		{name: "From", raw: "From: sender@example.com\r\n"},
+		{name: "Subject", raw: "Subject: hello\r\n"},
+	}
+	body := "hello, world\r\n"
+	sigValue, err := signer.sign(hdrs, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tag, sigBytes := splitDKIMSignature(t, sigValue)
+	var buf strings.Builder
+	buf.WriteString(canonicalizeHeaderRelaxed("from", "sender@example.com"))
+	buf.WriteString("\r\n")
+	buf.WriteString(canonicalizeHeaderRelaxed("subject", "hello"))
+	buf.WriteString("\r\n")
+	buf.WriteString(canonicalizeHeaderRelaxed("dkim-signature", tag))
+
+	h := sha256.Sum256([]byte(buf.String()))
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, h[:], sigBytes); err != nil {
+		t.Fatalf("signature did not verify: %v", err)
+	}
+}
+
+// TestDKIMSignsLastHeaderOccurrence pins down the RFC 6376 5.4
+// requirement that a repeated header signs its last (bottommost, i.e.
+// closest to the body) occurrence, not its first.
+func TestDKIMSignsLastHeaderOccurrence(t *testing.T) {
+	keyFile, key := genTestKey(t)
+	ds, err := newDKIMSigners([]dkimSignerConfig{
+		{domain: "example.com", selector: "mail", keyFile: keyFile, headers: []string{"from", "subject"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := ds.forDomain("sender@example.com")
+
+	hdrs := headerList{
+		{name: "Subject", raw: "Subject: first\r\n"},
+		{name: "From", raw: "From: sender@example.com\r\n"},
+		{name: "Subject", raw: "Subject: second\r\n"},
+	}
+	sigValue, err := signer.sign(hdrs, "body\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, sigBytes := splitDKIMSignature(t, sigValue)
+
+	verify := func(subject string) error {
+		var buf strings.Builder
+		buf.WriteString(canonicalizeHeaderRelaxed("from", "sender@example.com"))
+		buf.WriteString("\r\n")
+		buf.WriteString(canonicalizeHeaderRelaxed("subject", subject))
+		buf.WriteString("\r\n")
+		buf.WriteString(canonicalizeHeaderRelaxed("dkim-signature", tag))
+		h := sha256.Sum256([]byte(buf.String()))
+		return rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, h[:], sigBytes)
+	}
+
+	if err := verify("second"); err != nil {
+		t.Errorf("signature did not verify against the last Subject occurrence: %v", err)
+	}
+	if err := verify("first"); err == nil {
+		t.Error("signature verified against the first Subject occurrence; want only the last to verify")
+	}
+}
+
+// splitDKIMSignature splits a sign() return value into its tag (up to
+// and including "b=") and the decoded signature bytes.
+func splitDKIMSignature(t *testing.T, sigValue string) (string, []byte) {
+	t.Helper()
+	idx := strings.LastIndex(sigValue, "b=")
+	if idx < 0 {
+		t.Fatalf("signature value has no b= tag: %q", sigValue)
+	}
+	tag := sigValue[:idx+2]
+	sigBytes, err := base64.StdEncoding.DecodeString(sigValue[idx+2:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tag, sigBytes
+}
@@ -16,24 +16,49 @@ package main
 
 import (
 	"bufio"
-	"encoding/json"
+	"context"
+	"flag"
 	"fmt"
 	"log"
-	"net/http"
-	"net/mail"
 	"os"
 	"strings"
+	"time"
 )
 
-const rspamdURL = "http://localhost:11333/checkv2"
-
 var stdout *log.Logger
 
+var (
+	rc             *rspamdClient
+	rules          *acl
+	dkimSig        *dkimSigners
+	thr            *throttler
+	stats          *metrics
+	requestTimeout time.Duration
+	txBudget       time.Duration
+)
+
 type session struct {
-	ch      <-chan string
-	control map[string]string
-	id      string
-	payload *strings.Builder
+	ch         <-chan string
+	control    map[string]string
+	id         string
+	payload    *strings.Builder
+	aclVerdict aclVerdict
+	aclReason  string
+	ctx        context.Context
+	cancel     context.CancelFunc
+}
+
+// newTxCtx creates the context that bounds every rspamd request made
+// during a single transaction. It is replaced at tx-commit and
+// tx-rollback and cancelled outright at link-disconnect, so txBudget
+// is a per-transaction budget, not a cap on the whole connection: a
+// long-lived pipelined connection that keeps committing renews it
+// every time and is never cut off by it.
+func newTxCtx() (context.Context, context.CancelFunc) {
+	if txBudget > 0 {
+		return context.WithTimeout(context.Background(), txBudget)
+	}
+	return context.WithCancel(context.Background())
 }
 
 type rspamdResponse struct {
@@ -64,18 +89,56 @@ func txBegin(s *session, args []string) {
 	s.control["Queue-Id"] = args[6]
 }
 
+// recordACL folds an acl match into the session's transaction-wide
+// verdict, used once the whole message reaches the DATA phase. A deny
+// is sticky: once recorded it is never downgraded by a later
+// allow/skip. txMail records every "from" match here, since it applies
+// to every recipient in the transaction; txRcpt records only "rcpt"
+// allow/skip matches. A "rcpt" deny is scoped to the one recipient it
+// was evaluated against and must not force a transaction-wide reject
+// of recipients it never applied to, so txRcpt rejects it on the spot
+// instead of recording it.
+func (s *session) recordACL(v aclVerdict, reason string) {
+	if v == aclNone || s.aclVerdict == aclDeny {
+		return
+	}
+	s.aclVerdict, s.aclReason = v, reason
+}
+
 func txMail(s *session, args []string) {
-	mailFrom, status := args[7], args[8]
+	token, mailFrom, status := args[6], args[7], args[8]
+	verdict, reason := aclNone, ""
 	if status == "ok" {
 		s.control["From"] = mailFrom
+		verdict, reason = rules.match("from", mailFrom)
+		s.recordACL(verdict, reason)
 	}
+	if verdict == aclDeny {
+		stdout.Printf("filter-result|%s|%s|reject|%s\n", token, s.id, reason)
+		return
+	}
+	stdout.Printf("filter-result|%s|%s|proceed\n", token, s.id)
 }
 
 func txRcpt(s *session, args []string) {
-	rcptTo, status := args[7], args[8]
+	token, rcptTo, status := args[6], args[7], args[8]
+	verdict, reason := aclNone, ""
 	if status == "ok" {
 		s.control["Rcpt"] = rcptTo
+		verdict, reason = rules.match("rcpt", rcptTo)
+		// A rcpt-scoped deny only rejects this recipient below; it must
+		// not become the transaction-wide verdict dataOutput applies to
+		// the whole message, or an unrelated recipient's deny would
+		// bounce mail addressed to every other recipient too.
+		if verdict != aclDeny {
+			s.recordACL(verdict, reason)
+		}
 	}
+	if verdict == aclDeny {
+		stdout.Printf("filter-result|%s|%s|reject|%s\n", token, s.id, reason)
+		return
+	}
+	stdout.Printf("filter-result|%s|%s|proceed\n", token, s.id)
 }
 
 func txData(s *session, args []string) {
@@ -85,8 +148,32 @@ func txData(s *session, args []string) {
 	}
 }
 
-func txCleanup(s *session, args []string) {
+// txCommit clears the transaction state and starts a fresh txBudget
+// window for the next transaction on this connection: txBudget bounds
+// one transaction's requests, not the whole connection, so a
+// persistent/pipelined connection renews it on every commit instead of
+// eventually running against an expired context.
+func txCommit(s *session, args []string) {
 	s.control = nil
+	s.aclVerdict = aclNone
+	s.aclReason = ""
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.ctx, s.cancel = newTxCtx()
+}
+
+// txRollback clears the transaction state and starts a fresh txBudget
+// window the same way txCommit does, so a connection that keeps
+// transacting after a rollback is not left with a dead context either.
+func txRollback(s *session, args []string) {
+	s.control = nil
+	s.aclVerdict = aclNone
+	s.aclReason = ""
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.ctx, s.cancel = newTxCtx()
 }
 
 func filterCommit(s *session, args []string) {
@@ -107,79 +194,117 @@ func filterDataLine(s *session, args []string) {
 		s.payload.WriteString("\n")
 		return
 	}
-	s.ch = dataOutput(s.control, token, s.id, s.payload.String())
-}
-
-func rspamdPost(hdrs map[string]string, data string) (*rspamdResponse, error) {
-	r := strings.NewReader(data)
-	client := &http.Client{}
-	req, err := http.NewRequest("POST", rspamdURL, r)
-	if err != nil {
-		return nil, err
-	}
-	for k, v := range hdrs {
-		req.Header.Add(k, v)
-	}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
+	key := s.control["Ip"]
+	if key == "" {
+		key = s.control["Hostname"]
 	}
-	defer resp.Body.Close()
-	rr := &rspamdResponse{}
-	if err := json.NewDecoder(resp.Body).Decode(rr); err != nil {
-		return nil, err
+	ok, release := thr.acquire(key)
+	if !ok {
+		stats.incVerdict("throttled")
+		s.ch = rejectNow("451 try again later")
+		return
 	}
-	return rr, nil
+	out := dataOutput(s.ctx, s.control, token, s.id, s.payload.String(), s.aclVerdict, s.aclReason)
+	wrapped := make(chan string, 1)
+	go func() {
+		wrapped <- <-out
+		release()
+	}()
+	s.ch = wrapped
+}
+
+// rejectNow returns an already-fulfilled channel, used to short-circuit
+// dataOutput when a message is rejected before rspamd is consulted.
+func rejectNow(reason string) <-chan string {
+	ch := make(chan string, 1)
+	ch <- reason
+	return ch
 }
 
-func dataOutput(headers map[string]string,
-	token, id, data string) <-chan string {
-	ch := make(chan string)
+// lineWriter emits filter-dataline protocol lines for a single token/id.
+type lineWriter struct {
+	token, id string
+}
+
+func (w *lineWriter) WriteLine(line string) {
+	stdout.Printf("filter-dataline|%s|%s|%s\n", w.token, w.id, line)
+}
+
+func dataOutput(ctx context.Context, headers map[string]string, token, id, data string,
+	verdict aclVerdict, reason string) <-chan string {
+	ch := make(chan string, 1)
+	stats.incInFlight()
 	go func() {
-		resp, err := rspamdPost(headers, data)
-		if err != nil {
-			ch <- "421 Temporary failure"
+		defer stats.decInFlight()
+		if verdict == aclDeny {
+			stats.incVerdict("acl-deny")
+			ch <- reason
 			return
 		}
-		log.Printf("%v\n", resp)
-		m, err := mail.ReadMessage(strings.NewReader(data))
+		var resp *rspamdResponse
+		if verdict != aclSkip {
+			reqCtx, cancel := context.WithTimeout(ctx, requestTimeout)
+			var err error
+			start := time.Now()
+			resp, err = rc.post(reqCtx, headers, data)
+			stats.observeLatency(time.Since(start))
+			cancel()
+			if err != nil {
+				if isTimeout(err) {
+					stats.incVerdict("timeout")
+					ch <- "451 try again later"
+				} else {
+					stats.incVerdict("error")
+					ch <- "421 Temporary failure"
+				}
+				return
+			}
+			log.Printf("%v\n", resp)
+		}
+		hdrs, body, err := parseHeaders(data)
 		if err != nil {
 			ch <- "421 Temporary failure"
 			return
 		}
 		rejectReason := ""
-		switch resp.Action {
-		case "add header":
-			m.Header["X-Spam"] = []string{"yes"}
-			m.Header["X-Spam-Score"] = []string{
-				fmt.Sprintf("%v / %v",
-					resp.Score, resp.RequiredScore)}
-		case "rewrite subject":
-			m.Header["Subject"] = []string{resp.Subject}
-		case "reject":
-			rejectReason = "550 message rejected"
-		case "greylist":
-			rejectReason = "421 greylisted"
-		case "soft reject":
-			rejectReason = "451 try again later"
+		if resp != nil {
+			switch resp.Action {
+			case "add header":
+				hdrs.set("X-Spam", "yes")
+				hdrs.set("X-Spam-Score", fmt.Sprintf("%v / %v", resp.Score, resp.RequiredScore))
+			case "rewrite subject":
+				hdrs.set("Subject", resp.Subject)
+			case "reject":
+				rejectReason = "550 message rejected"
+			case "greylist":
+				rejectReason = "421 greylisted"
+			case "soft reject":
+				rejectReason = "451 try again later"
+			}
 		}
-		// Write DKIM-Signature header first if present
-		if resp.DKIMSig != "" {
-			stdout.Printf("filter-dataline|%s|%s|%s: %s\n",
-				token, id, "DKIM-Signature", resp.DKIMSig)
+		// Fall back to a local signature when rspamd did not sign.
+		if resp != nil && resp.DKIMSig == "" {
+			if signer := dkimSig.forDomain(headers["From"]); signer != nil {
+				if sig, err := signer.sign(hdrs, body); err == nil {
+					resp.DKIMSig = sig
+				} else {
+					log.Printf("dkim: %v\n", err)
+				}
+			}
 		}
-		// preserve order?
-		for k, v := range m.Header {
-			stdout.Printf("filter-dataline|%s|%s|%s: %s\n",
-				token, id, k, strings.Join(v, ","))
+		if resp != nil && resp.DKIMSig != "" {
+			hdrs.prepend("DKIM-Signature", resp.DKIMSig)
 		}
-		// Blank line seperates headers and body
-		stdout.Printf("filter-dataline|%s|%s|\n", token, id)
-		s := bufio.NewScanner(m.Body)
-		for s.Scan() {
-			stdout.Printf("filter-dataline|%s|%s|%s\n",
-				token, id, s.Text())
+		if verdict == aclSkip {
+			stats.incVerdict("acl-skip")
+		} else if resp != nil {
+			action := resp.Action
+			if action == "" {
+				action = "no action"
+			}
+			stats.incVerdict(action)
 		}
+		hdrs.writeTo(&lineWriter{token: token, id: id}, body)
 		stdout.Printf("filter-dataline|%s|%s|%s\n", token, id, ".")
 		ch <- rejectReason
 	}()
@@ -187,9 +312,32 @@ func dataOutput(headers map[string]string,
 }
 
 func main() {
+	confPath := flag.String("f", defaultConfigPath, "config file path")
+	flag.Parse()
 	log.SetFlags(0)
 	log.SetPrefix("filter_rspamd: ")
 	stdout = log.New(os.Stdout, "", 0)
+	cfg, err := loadConfig(*confPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	requestTimeout = cfg.requestTimeout
+	txBudget = cfg.txBudget
+	rc, err = newRspamdClient(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rules, err = newACL(cfg.aclRules)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dkimSig, err = newDKIMSigners(cfg.dkimSigners)
+	if err != nil {
+		log.Fatal(err)
+	}
+	thr = newThrottler(cfg.throttle)
+	stats = newMetrics()
+	serveMetrics(cfg.throttle.metricsListen, stats)
 	registry := map[string]struct {
 		kind string
 		fn   func(*session, []string)
@@ -199,10 +347,10 @@ func main() {
 		"link-identify":   {"report", linkIdentify},
 		"tx-begin":        {"report", txBegin},
 		"tx-data":         {"report", txData},
-		"tx-mail":         {"report", txMail},
-		"tx-rcpt":         {"report", txRcpt},
-		"tx-commit":       {"report", txCleanup},
-		"tx-rollback":     {"report", txCleanup},
+		"tx-mail":         {"filter", txMail},
+		"tx-rcpt":         {"filter", txRcpt},
+		"tx-commit":       {"report", txCommit},
+		"tx-rollback":     {"report", txRollback},
 		"commit":          {"filter", filterCommit},
 		"data-line":       {"filter", filterDataLine},
 	}
@@ -218,12 +366,18 @@ func main() {
 		event, id = fields[4], fields[5]
 		switch event {
 		case "link-disconnect":
+			if s := sessions[id]; s != nil && s.cancel != nil {
+				s.cancel()
+			}
 			delete(sessions, id)
 		case "link-connect":
+			ctx, cancel := newTxCtx()
 			sessions[id] = &session{
 				control: map[string]string{},
 				id:      id,
-				payload: &strings.Builder{}}
+				payload: &strings.Builder{},
+				ctx:     ctx,
+				cancel:  cancel}
 			fallthrough
 		default:
 			if sessions[id] != nil {
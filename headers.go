@@ -0,0 +1,134 @@
+// Copyright (c) 2019 Sunil Nimmagadda <sunil@nimmagadda.net>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/textproto"
+	"strings"
+)
+
+// rawHeader is one message header kept exactly as it was written on
+// the wire, folding and all, so it can be re-emitted unmodified.
+type rawHeader struct {
+	name string // header name as first seen, e.g. "DKIM-Signature"
+	raw  string // "Name: value" plus any folded continuation lines, CRLF intact
+}
+
+// headerList is an ordered set of headers, preserving both the
+// original ordering and any RFC 5322 folding.
+type headerList []rawHeader
+
+// parseHeaders reads the header block of a message up to the first
+// blank line, preserving raw bytes (including folding) instead of
+// going through net/mail's unordered map. It returns the headers in
+// the order they appeared and the remaining, unconsumed body.
+func parseHeaders(data string) (headerList, string, error) {
+	r := bufio.NewReader(strings.NewReader(data))
+	var hdrs headerList
+	var curName string
+	var curRaw strings.Builder
+	flush := func() {
+		if curName != "" {
+			hdrs = append(hdrs, rawHeader{name: curName, raw: curRaw.String()})
+		}
+		curName = ""
+		curRaw.Reset()
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, "", err
+		}
+		trimmed := strings.TrimRight(line, "\r\n")
+		if trimmed == "" {
+			flush()
+			break
+		}
+		if (line[0] == ' ' || line[0] == '\t') && curName != "" {
+			curRaw.WriteString(line)
+		} else {
+			flush()
+			idx := strings.IndexByte(trimmed, ':')
+			if idx < 0 {
+				continue
+			}
+			curName = strings.TrimSpace(trimmed[:idx])
+			curRaw.WriteString(line)
+		}
+		if err == io.EOF {
+			flush()
+			break
+		}
+	}
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, "", err
+	}
+	return hdrs, string(body), nil
+}
+
+// values returns the unfolded value of every header named name, in
+// the order they appear.
+func (hl headerList) values(name string) []string {
+	cname := textproto.CanonicalMIMEHeaderKey(name)
+	var out []string
+	for _, h := range hl {
+		if textproto.CanonicalMIMEHeaderKey(h.name) != cname {
+			continue
+		}
+		raw := h.raw
+		if idx := strings.IndexByte(raw, ':'); idx >= 0 {
+			raw = raw[idx+1:]
+		}
+		raw = strings.NewReplacer("\r\n", " ", "\n", " ").Replace(raw)
+		out = append(out, strings.TrimSpace(raw))
+	}
+	return out
+}
+
+// set replaces the first header named name with a single-line
+// "name: value" header, or prepends one if none exists.
+func (hl *headerList) set(name, value string) {
+	cname := textproto.CanonicalMIMEHeaderKey(name)
+	for i, h := range *hl {
+		if textproto.CanonicalMIMEHeaderKey(h.name) == cname {
+			(*hl)[i] = rawHeader{name: name, raw: name + ": " + value + "\r\n"}
+			return
+		}
+	}
+	hl.prepend(name, value)
+}
+
+// prepend inserts a new single-line header at the start of the list.
+func (hl *headerList) prepend(name, value string) {
+	*hl = append(headerList{{name: name, raw: name + ": " + value + "\r\n"}}, *hl...)
+}
+
+// writeTo emits the headers followed by the blank line separator and
+// body, one filter-dataline per wire line, preserving folding.
+func (hl headerList) writeTo(w *lineWriter, body string) {
+	for _, h := range hl {
+		for _, line := range strings.Split(strings.TrimRight(h.raw, "\r\n"), "\n") {
+			w.WriteLine(strings.TrimRight(line, "\r"))
+		}
+	}
+	w.WriteLine("")
+	s := bufio.NewScanner(strings.NewReader(body))
+	for s.Scan() {
+		w.WriteLine(s.Text())
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2019 Sunil Nimmagadda <sunil@nimmagadda.net>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const initialBackoff = 200 * time.Millisecond
+
+// rspamdEndpoint is an endpointConfig with its http.Client built once
+// and reused across sessions.
+type rspamdEndpoint struct {
+	url                string
+	username, password string
+	controllerPassword string
+	client             *http.Client
+}
+
+// rspamdClient fans requests out across one or more rspamd endpoints,
+// trying each in turn until one succeeds.
+type rspamdClient struct {
+	endpoints []*rspamdEndpoint
+}
+
+func newRspamdClient(cfg *config) (*rspamdClient, error) {
+	rc := &rspamdClient{}
+	for _, ec := range cfg.endpoints {
+		client, err := newHTTPClient(ec)
+		if err != nil {
+			return nil, fmt.Errorf("rspamd: %w", err)
+		}
+		rc.endpoints = append(rc.endpoints, &rspamdEndpoint{
+			url:                fmt.Sprintf("%s://%s:%s%s", ec.scheme, ec.host, ec.port, ec.path),
+			username:           ec.username,
+			password:           ec.password,
+			controllerPassword: ec.controllerPassword,
+			client:             client,
+		})
+	}
+	return rc, nil
+}
+
+func newHTTPClient(ec *endpointConfig) (*http.Client, error) {
+	tr := &http.Transport{}
+	if ec.scheme == "https" {
+		tlsConfig := &tls.Config{InsecureSkipVerify: ec.insecureSkipVerify}
+		if ec.caFile != "" {
+			pool := x509.NewCertPool()
+			pem, err := os.ReadFile(ec.caFile)
+			if err != nil {
+				return nil, err
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", ec.caFile)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		if ec.clientCertFile != "" && ec.clientKeyFile != "" {
+			cert, err := tls.LoadX509KeyPair(ec.clientCertFile, ec.clientKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		tr.TLSClientConfig = tlsConfig
+	}
+	return &http.Client{Transport: tr, Timeout: ec.timeout}, nil
+}
+
+// post submits data to the first reachable endpoint, retrying the
+// remaining endpoints with an exponential backoff between attempts.
+// The request (and any backoff wait) is bound to ctx, so a cancelled
+// or expired ctx aborts the attempt in progress instead of leaking it.
+func (rc *rspamdClient) post(ctx context.Context, hdrs map[string]string, data string) (*rspamdResponse, error) {
+	var lastErr error
+	backoff := initialBackoff
+	for i, ep := range rc.endpoints {
+		if i > 0 {
+			t := time.NewTimer(backoff)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return nil, ctx.Err()
+			}
+			backoff *= 2
+		}
+		resp, err := ep.post(ctx, hdrs, data)
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	return nil, lastErr
+}
+
+// isTimeout reports whether err represents a request that failed to
+// complete before its deadline or whose context was cancelled. The
+// per-endpoint http.Client.Timeout
+// commonly fires before the outer ctx deadline does, and Go surfaces
+// that as a *url.Error wrapping a net.Error, not the context sentinel
+// errors.Is(err, context.DeadlineExceeded) expects.
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func (ep *rspamdEndpoint) post(ctx context.Context, hdrs map[string]string, data string) (*rspamdResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", ep.url, strings.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range hdrs {
+		req.Header.Add(k, v)
+	}
+	if ep.username != "" {
+		req.SetBasicAuth(ep.username, ep.password)
+	}
+	if ep.controllerPassword != "" {
+		req.Header.Set("Password", ep.controllerPassword)
+	}
+	resp, err := ep.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	rr := &rspamdResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(rr); err != nil {
+		return nil, err
+	}
+	return rr, nil
+}
@@ -0,0 +1,210 @@
+// Copyright (c) 2019 Sunil Nimmagadda <sunil@nimmagadda.net>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ipBucket tracks the in-flight count and rate-limit window for a
+// single remote IP (or Hostname, when no IP is known).
+type ipBucket struct {
+	inFlight    int
+	count       int
+	windowStart time.Time
+	lastSeen    time.Time
+}
+
+// throttler enforces a global concurrency cap, a per-IP concurrency
+// cap and a per-IP fixed-window rate limit (at most rateLimit scans
+// per rateWindow, the count resetting once the window has elapsed) on
+// rspamd scans. A zero value for any limit disables that particular
+// check.
+type throttler struct {
+	mu     sync.Mutex
+	cfg    throttleConfig
+	global int
+	perIP  map[string]*ipBucket
+	lastGC time.Time
+}
+
+const throttleGCInterval = 5 * time.Minute
+const throttleIdleAge = 10 * time.Minute
+
+func newThrottler(cfg throttleConfig) *throttler {
+	return &throttler{cfg: cfg, perIP: map[string]*ipBucket{}, lastGC: time.Now()}
+}
+
+// acquire reserves a scanning slot for key (an IP or hostname). It
+// returns false when a configured limit is exceeded, in which case no
+// slot was reserved and release must not be called.
+func (t *throttler) acquire(key string) (ok bool, release func()) {
+	if t == nil {
+		return true, func() {}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.gcLocked(now)
+
+	if t.cfg.maxConcurrent > 0 && t.global >= t.cfg.maxConcurrent {
+		return false, nil
+	}
+	b := t.perIP[key]
+	if b == nil {
+		b = &ipBucket{windowStart: now}
+		t.perIP[key] = b
+	}
+	b.lastSeen = now
+	if t.cfg.maxConcurrentPerIP > 0 && b.inFlight >= t.cfg.maxConcurrentPerIP {
+		return false, nil
+	}
+	if t.cfg.rateLimit > 0 {
+		if now.Sub(b.windowStart) > t.cfg.rateWindow {
+			b.windowStart = now
+			b.count = 0
+		}
+		if b.count >= t.cfg.rateLimit {
+			return false, nil
+		}
+		b.count++
+	}
+
+	t.global++
+	b.inFlight++
+	var once sync.Once
+	return true, func() {
+		once.Do(func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.global--
+			if b := t.perIP[key]; b != nil {
+				b.inFlight--
+			}
+		})
+	}
+}
+
+// gcLocked drops per-IP state that has been idle for a while so long
+// running processes do not leak entries. Callers must hold t.mu.
+func (t *throttler) gcLocked(now time.Time) {
+	if now.Sub(t.lastGC) < throttleGCInterval {
+		return
+	}
+	t.lastGC = now
+	for k, b := range t.perIP {
+		if b.inFlight == 0 && now.Sub(b.lastSeen) > throttleIdleAge {
+			delete(t.perIP, k)
+		}
+	}
+}
+
+// metrics holds the counters exposed on the optional /metrics endpoint.
+type metrics struct {
+	inFlight       int64
+	verdicts       sync.Map // string -> *int64
+	latencyCount   int64
+	latencySum     int64 // nanoseconds
+	latencyBuckets []int64
+}
+
+var latencyBucketBoundsSeconds = []float64{0.1, 0.5, 1, 2, 5, 10}
+
+func newMetrics() *metrics {
+	return &metrics{latencyBuckets: make([]int64, len(latencyBucketBoundsSeconds)+1)}
+}
+
+func (m *metrics) incInFlight() {
+	if m != nil {
+		atomic.AddInt64(&m.inFlight, 1)
+	}
+}
+
+func (m *metrics) decInFlight() {
+	if m != nil {
+		atomic.AddInt64(&m.inFlight, -1)
+	}
+}
+
+func (m *metrics) incVerdict(verdict string) {
+	if m == nil {
+		return
+	}
+	v, _ := m.verdicts.LoadOrStore(verdict, new(int64))
+	atomic.AddInt64(v.(*int64), 1)
+}
+
+func (m *metrics) observeLatency(d time.Duration) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.latencyCount, 1)
+	atomic.AddInt64(&m.latencySum, int64(d))
+	secs := d.Seconds()
+	for i, bound := range latencyBucketBoundsSeconds {
+		if secs <= bound {
+			atomic.AddInt64(&m.latencyBuckets[i], 1)
+			return
+		}
+	}
+	atomic.AddInt64(&m.latencyBuckets[len(latencyBucketBoundsSeconds)], 1)
+}
+
+// handler renders the counters in Prometheus text exposition format.
+func (m *metrics) handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# HELP filter_rspamd_in_flight Number of rspamd scans currently in flight.\n")
+	fmt.Fprintf(w, "# TYPE filter_rspamd_in_flight gauge\n")
+	fmt.Fprintf(w, "filter_rspamd_in_flight %d\n", atomic.LoadInt64(&m.inFlight))
+
+	fmt.Fprintf(w, "# HELP filter_rspamd_verdicts_total Number of messages per rspamd verdict.\n")
+	fmt.Fprintf(w, "# TYPE filter_rspamd_verdicts_total counter\n")
+	m.verdicts.Range(func(k, v any) bool {
+		fmt.Fprintf(w, "filter_rspamd_verdicts_total{verdict=%q} %d\n", k, atomic.LoadInt64(v.(*int64)))
+		return true
+	})
+
+	fmt.Fprintf(w, "# HELP filter_rspamd_latency_seconds rspamd request latency.\n")
+	fmt.Fprintf(w, "# TYPE filter_rspamd_latency_seconds histogram\n")
+	var cumulative int64
+	for i, bound := range latencyBucketBoundsSeconds {
+		cumulative += atomic.LoadInt64(&m.latencyBuckets[i])
+		fmt.Fprintf(w, "filter_rspamd_latency_seconds_bucket{le=\"%v\"} %d\n", bound, cumulative)
+	}
+	cumulative += atomic.LoadInt64(&m.latencyBuckets[len(latencyBucketBoundsSeconds)])
+	fmt.Fprintf(w, "filter_rspamd_latency_seconds_bucket{le=\"+Inf\"} %d\n", cumulative)
+	fmt.Fprintf(w, "filter_rspamd_latency_seconds_sum %f\n", time.Duration(atomic.LoadInt64(&m.latencySum)).Seconds())
+	fmt.Fprintf(w, "filter_rspamd_latency_seconds_count %d\n", atomic.LoadInt64(&m.latencyCount))
+}
+
+// serveMetrics starts the /metrics listener in the background when an
+// address is configured. It never blocks the caller.
+func serveMetrics(addr string, m *metrics) {
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", m.handler)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			stdout.Printf("metrics: %v\n", err)
+		}
+	}()
+}